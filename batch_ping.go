@@ -1,12 +1,13 @@
 package ping
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/icmp"
@@ -17,10 +18,64 @@ import (
 // BatchPinger is Pinger manager
 type BatchPinger struct {
 	// pingers []*Pinger
-	done chan bool
-
-	//mapSeqPinger is seqId pinger map
-	mapSeqPinger map[int]*Pinger
+	done     chan bool
+	stopOnce sync.Once
+
+	//shards holds the addrs split into groups of at most maxShardSize, each
+	//with its own seq space. A single shard behaves exactly as mapSeqPinger
+	//used to.
+	shards []*shard
+
+	// parallelism caps how many shards send/await replies concurrently.
+	parallelism int
+
+	// maxInflight caps how many un-replied-to requests a shard may have
+	// outstanding at once. 0 means unbounded.
+	maxInflight int
+
+	// shardsRemaining counts shards that haven't finished their normal
+	// count/timeout run yet. The shard that decrements it to 0 is the one
+	// that calls Stop, so the shared conns/recv loops stay up until every
+	// shard - not just the first one through, as SetParallelism(1) runs
+	// them sequentially - has actually finished.
+	shardsRemaining int32
+
+	// resolver resolves hostnames to IPs; defaultResolver{} unless
+	// SetResolver overrides it.
+	resolver Resolver
+
+	// resolveInterval, if non-zero, makes RunContext re-resolve every
+	// hostname addr this often between rounds. 0 disables re-resolution.
+	resolveInterval time.Duration
+
+	// addrMu guards every pinger.addr write a resolver retarget makes
+	// against the concurrent reads Statistics does: a run with
+	// SetResolveInterval set is meant to be polled while still in flight
+	// (that's the whole point of the OnRecv/OnFinish callbacks), so those
+	// two can genuinely run on different goroutines at once.
+	addrMu sync.RWMutex
+
+	// ipHistoryMu guards ipHistory.
+	ipHistoryMu sync.Mutex
+
+	// ipHistory records, per hostname addr, every distinct IP
+	// SetResolveInterval has re-resolved it to. Read via IPHistory.
+	ipHistory map[string][]net.IPAddr
+
+	// outstandingMu guards outstanding.
+	outstandingMu sync.Mutex
+
+	// outstanding tracks in-flight echo requests keyed by (seq, token) so
+	// replies can be matched to the exact round that sent them.
+	outstanding map[outstandingKey]*outstandingRequest
+
+	// adHocSeq hands out seq IDs for Ping. Since nextAdHocSeq truncates to
+	// the wire uint16 value, it collides with the 1..len(shard) range a
+	// shard assigns to mapSeqPinger from its second call onward - that's
+	// expected and safe only because the (seq, token) key in outstanding
+	// still disambiguates a Ping request from any shard's request sharing
+	// the same seq.
+	adHocSeq int32
 
 	// interval is the wait time between each packet send. Default is 1s.
 	interval time.Duration
@@ -36,9 +91,6 @@ type BatchPinger struct {
 	//count is ping num for every addr
 	count int
 
-	//sendCount is the num has send
-	sendCount int
-
 	//source is source ip, can use this ip listen
 	source string
 
@@ -48,6 +100,11 @@ type BatchPinger struct {
 	//id is the process id, should drop the pkg of other process
 	id int
 
+	// connMu guards conn4/conn6: RunContext writes them once at startup,
+	// but Ping can be called concurrently from a caller's own goroutine
+	// before that write has happened, racing the nil check otherwise.
+	connMu sync.RWMutex
+
 	//conn4 is ipv4 icmp PacketConn
 	conn4 *icmp.PacketConn
 
@@ -62,15 +119,24 @@ type BatchPinger struct {
 
 	// OnFinish can be called when Pinger exits
 	OnFinish func(map[string]*Statistics)
+
+	// OnSend is called right after an echo request is written to addr.
+	OnSend func(addr string, seq int)
+
+	// OnRecv is called for every matched echo reply.
+	OnRecv func(addr string, seq int, rtt time.Duration, ttl int)
+
+	// OnTimeout is called once an addr's round has been superseded by the
+	// next send, or its shard has finished, without a matching reply ever
+	// arriving.
+	OnTimeout func(addr string, seq int)
 }
 
-//NewBatchPinger returns a new Pinger struct pointer, interval is default 1s, count default 5, count should not more than 65535
+//NewBatchPinger returns a new Pinger struct pointer, interval is default 1s, count default 5.
+//addrs can number more than 65535: they are sharded into groups of at most 65535 so each
+//shard gets its own ICMP seq space. Use SetParallelism to control how many shards run at once.
 func NewBatchPinger(addrs []string, privileged bool) (batachPinger *BatchPinger, err error) {
 
-	// addrs can not more than 65535
-	if len(addrs) > 0xffff {
-		return nil, errors.New("addr can not more than 65535")
-	}
 	var network string
 	if privileged {
 		network = "ip"
@@ -79,14 +145,17 @@ func NewBatchPinger(addrs []string, privileged bool) (batachPinger *BatchPinger,
 	}
 
 	batachPinger = &BatchPinger{
-		interval:     time.Second,
-		timeout:      time.Second * 100000,
-		count:        5,
-		network:      network,
-		id:           getPId(),
-		mapSeqPinger: make(map[int]*Pinger),
-		done:         make(chan bool),
-		addrs:        addrs,
+		interval:    time.Second,
+		timeout:     time.Second * 100000,
+		count:       5,
+		network:     network,
+		id:          getPId(),
+		parallelism: 1,
+		outstanding: make(map[outstandingKey]*outstandingRequest),
+		done:        make(chan bool),
+		addrs:       addrs,
+		resolver:    defaultResolver{},
+		ipHistory:   make(map[string][]net.IPAddr),
 	}
 
 	return batachPinger, nil
@@ -124,43 +193,90 @@ func getPId() int {
 
 // Run will multi-ping addrs
 func (bp *BatchPinger) Run() (err error) {
-	if bp.conn4, err = icmp.ListenPacket(ipv4Proto[bp.network], bp.source); err != nil {
+	return bp.RunContext(context.Background())
+}
+
+// RunContext behaves like Run but also returns as soon as ctx is canceled or
+// its deadline expires, via Stop; cancellation is honored by the send/recv
+// select loops below, not by interrupting the listen itself.
+func (bp *BatchPinger) RunContext(ctx context.Context) (err error) {
+	conn4, err := icmp.ListenPacket(ipv4Proto[bp.network], bp.source)
+	if err != nil {
 		return err
 	}
-	if bp.conn6, err = icmp.ListenPacket(ipv6Proto[bp.network], bp.source); err != nil {
+
+	conn6, err := icmp.ListenPacket(ipv6Proto[bp.network], bp.source)
+	if err != nil {
+		conn4.Close()
 		return err
 	}
-	bp.conn4.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
-	bp.conn6.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
 
-	var seqID int
-	for _, addr := range bp.addrs {
-		seqID++
-		pinger, err := NewPinger(addr, bp.id, seqID, bp.network)
-		if err != nil {
-			return err
+	conn4.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+	conn6.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+
+	bp.connMu.Lock()
+	bp.conn4, bp.conn6 = conn4, conn6
+	bp.connMu.Unlock()
+
+	bp.shards = nil
+	for _, addrs := range shardAddrs(bp.addrs) {
+		sh := newShard(addrs, bp.maxInflight)
+
+		var seqID int
+		for _, addr := range addrs {
+			seqID++
+			pinger, err := NewPinger(addr, bp.id, seqID, bp.network)
+			if err != nil {
+				return err
+			}
+			sh.mapSeqPinger[seqID] = pinger
+			sh.hosts[seqID] = addr
+			pinger.SetConns(bp.conn4, bp.conn6)
 		}
-		bp.mapSeqPinger[seqID] = pinger
-		pinger.SetConns(bp.conn4, bp.conn6)
+
+		bp.shards = append(bp.shards, sh)
 	}
+	atomic.StoreInt32(&bp.shardsRemaining, int32(len(bp.shards)))
 
 	if bp.debug {
-		log.Printf("[debug] pid %d \n", bp.id)
+		log.Printf("[debug] pid %d shards %d parallelism %d \n", bp.id, len(bp.shards), bp.parallelism)
 	}
 
 	defer bp.conn4.Close()
 	defer bp.conn6.Close()
 
 	var wg sync.WaitGroup
-	wg.Add(3)
-	go bp.recvIpv4(&wg)
-	go bp.recvIpv6(&wg)
-	go bp.sendICMP(&wg)
+	wg.Add(2 + len(bp.shards))
+	go bp.recvIpv4(ctx, &wg)
+	go bp.recvIpv6(ctx, &wg)
+
+	sem := make(chan struct{}, bp.parallelism)
+	for _, sh := range bp.shards {
+		go bp.runShard(ctx, sh, &wg, sem)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			bp.Stop()
+		case <-bp.done:
+		}
+	}()
+
 	wg.Wait()
 	return nil
 }
 
-func (bp *BatchPinger) recvIpv4(wg *sync.WaitGroup) {
+// Stop closes bp.done, telling the send/recv goroutines started by Run or
+// RunContext to exit. It is safe to call Stop more than once or from
+// multiple goroutines.
+func (bp *BatchPinger) Stop() {
+	bp.stopOnce.Do(func() {
+		close(bp.done)
+	})
+}
+
+func (bp *BatchPinger) recvIpv4(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	var ttl int
 
@@ -168,6 +284,8 @@ func (bp *BatchPinger) recvIpv4(wg *sync.WaitGroup) {
 		select {
 		case <-bp.done:
 			return
+		case <-ctx.Done():
+			return
 		default:
 			bytes := make([]byte, 512)
 			bp.conn4.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
@@ -198,13 +316,15 @@ func (bp *BatchPinger) recvIpv4(wg *sync.WaitGroup) {
 	}
 }
 
-func (bp *BatchPinger) recvIpv6(wg *sync.WaitGroup) {
+func (bp *BatchPinger) recvIpv6(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	var ttl int
 	for {
 		select {
 		case <-bp.done:
 			return
+		case <-ctx.Done():
+			return
 		default:
 			bytes := make([]byte, 512)
 			bp.conn6.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
@@ -230,29 +350,59 @@ func (bp *BatchPinger) recvIpv6(wg *sync.WaitGroup) {
 	}
 }
 
-func (bp *BatchPinger) sendICMP(wg *sync.WaitGroup) {
+// runShard drives one shard's send loop. It first waits for a slot in sem,
+// the worker pool SetParallelism sizes, so at most bp.parallelism shards are
+// ever sending/awaiting replies at once; the interval/count/timeout loop
+// inside mirrors what a single un-sharded BatchPinger always ran.
+func (bp *BatchPinger) runShard(ctx context.Context, sh *shard, wg *sync.WaitGroup, sem chan struct{}) {
 	defer wg.Done()
+
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return
+	case <-bp.done:
+		return
+	}
+	defer func() { <-sem }()
+
 	timeout := time.NewTicker(bp.timeout)
 	interval := time.NewTicker(bp.interval)
+	defer timeout.Stop()
+	defer interval.Stop()
+
+	var resolveC <-chan time.Time
+	if bp.resolveInterval > 0 {
+		resolveTicker := time.NewTicker(bp.resolveInterval)
+		defer resolveTicker.Stop()
+		resolveC = resolveTicker.C
+	}
 
+	var sendCount int
 	for {
 		select {
 		case <-bp.done:
 			return
 
+		case <-ctx.Done():
+			return
+
 		case <-timeout.C:
-			close(bp.done)
+			bp.shardFinished(sh)
 			return
 
+		case <-resolveC:
+			bp.reresolveShard(ctx, sh)
+
 		case <-interval.C:
-			bp.batchSendICMP()
-			bp.sendCount++
-			if bp.sendCount >= bp.count {
+			bp.batchSendShard(sh)
+			sendCount++
+			if sendCount >= bp.count {
 				time.Sleep(bp.interval)
-				close(bp.done)
 				if bp.debug {
-					log.Printf("send end sendcout %d, count %d \n", bp.sendCount, bp.count)
+					log.Printf("shard send end sendcout %d, count %d \n", sendCount, bp.count)
 				}
+				bp.shardFinished(sh)
 
 				return
 			}
@@ -260,12 +410,153 @@ func (bp *BatchPinger) sendICMP(wg *sync.WaitGroup) {
 	}
 }
 
-// batchSendICMP let all addr send pkg once
-func (bp *BatchPinger) batchSendICMP() {
-	for _, pinger := range bp.mapSeqPinger {
-		pinger.SendICMP()
+// shardFinished marks one shard done with its normal count/timeout run. It
+// sweeps sh's own outstanding requests first - the final round's sends
+// would otherwise sit in bp.outstanding forever, since only a subsequent
+// send ever evicts a seq's prior request, and a finishing shard sends no
+// more. Only once every shard has called shardFinished does it close
+// bp.done - calling Stop from a single shard's own completion would tear
+// down the shared conns/recv loops, and every other shard's sem-wait select
+// would then exit before ever sending a packet, which is exactly what
+// happened with the documented default SetParallelism(1): shard 1
+// finishing silently skipped every subsequent shard.
+func (bp *BatchPinger) shardFinished(sh *shard) {
+	bp.sweepOutstanding(sh)
+	if atomic.AddInt32(&bp.shardsRemaining, -1) <= 0 {
+		bp.Stop()
+	}
+}
+
+// sweepOutstanding reports as timed-out, and releases, every one of sh's
+// requests still sitting in bp.outstanding. It only needs to check the
+// (seq, token) sh.activeKeyBySeq last recorded for each seq: any earlier
+// key for that seq was already evicted by a later send.
+func (bp *BatchPinger) sweepOutstanding(sh *shard) {
+	sh.activeKeyMu.Lock()
+	activeKeys := make(map[int]outstandingKey, len(sh.activeKeyBySeq))
+	for seq, key := range sh.activeKeyBySeq {
+		activeKeys[seq] = key
+	}
+	sh.activeKeyMu.Unlock()
+
+	for seq, key := range activeKeys {
+		bp.outstandingMu.Lock()
+		req, ok := bp.outstanding[key]
+		if ok {
+			delete(bp.outstanding, key)
+		}
+		bp.outstandingMu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		if bp.OnTimeout != nil {
+			bp.OnTimeout(req.addr, seq)
+		}
+		if req.release != nil {
+			req.release()
+		}
+	}
+}
+
+// batchSendShard lets every pinger in the shard send once. Seq IDs are
+// recycled every round, so before resending on a seq it evicts and reports
+// as timed-out whatever request that seq last carried if it never got a
+// reply - otherwise a stale reply for the old round could be mistaken for
+// the new one purely by seq collision.
+func (bp *BatchPinger) batchSendShard(sh *shard) {
+	for _, pinger := range sh.mapSeqPinger {
+		sh.activeKeyMu.Lock()
+		prevKey, ok := sh.activeKeyBySeq[pinger.seq]
+		sh.activeKeyMu.Unlock()
+
+		if ok {
+			bp.outstandingMu.Lock()
+			prevReq, stillPending := bp.outstanding[prevKey]
+			if stillPending {
+				delete(bp.outstanding, prevKey)
+			}
+			bp.outstandingMu.Unlock()
+
+			if stillPending {
+				if bp.OnTimeout != nil {
+					bp.OnTimeout(prevReq.addr, pinger.seq)
+				}
+				if prevReq.release != nil {
+					prevReq.release()
+				}
+			}
+		}
+
+		if sh.inflight != nil {
+			select {
+			case sh.inflight <- struct{}{}:
+			default:
+				// At MaxInflight cap; try this pinger again next round.
+				continue
+			}
+		}
+
+		tok, err := newToken()
+		if err != nil {
+			if bp.debug {
+				log.Printf("token gen err %s \n", err)
+			}
+			if sh.inflight != nil {
+				<-sh.inflight
+			}
+			continue
+		}
+
+		var release func()
+		if sh.inflight != nil {
+			release = func() { <-sh.inflight }
+		}
+
+		key := outstandingKey{seq: pinger.seq, token: tok}
+		bp.outstandingMu.Lock()
+		bp.outstanding[key] = &outstandingRequest{
+			addr:    pinger.addr,
+			sentAt:  time.Now(),
+			pinger:  pinger,
+			release: release,
+		}
+		bp.outstandingMu.Unlock()
+
+		sh.activeKeyMu.Lock()
+		sh.activeKeyBySeq[pinger.seq] = key
+		sh.activeKeyMu.Unlock()
+
+		pinger.SendICMP(tok[:])
 		pinger.PacketsSent++
+		if bp.OnSend != nil {
+			bp.OnSend(pinger.addr, pinger.seq)
+		}
+	}
+}
+
+// pingerBySeq looks up the pinger that most recently sent seq with tok,
+// across all shards; only needed on the cold path where a reply couldn't be
+// matched to an outstanding request at all. Every shard numbers its own
+// mapSeqPinger 1..len(shard), so seq alone collides routinely once a batch
+// has more than one shard - tok, which sh.activeKeyBySeq retains for a seq
+// even after the matching bp.outstanding entry has been consumed or
+// evicted, is what actually identifies which shard's pinger sent this
+// reply.
+func (bp *BatchPinger) pingerBySeq(seq int, tok token) (*Pinger, bool) {
+	for _, sh := range bp.shards {
+		sh.activeKeyMu.Lock()
+		key, ok := sh.activeKeyBySeq[seq]
+		sh.activeKeyMu.Unlock()
+
+		if ok && key.token == tok {
+			if pinger, ok := sh.mapSeqPinger[seq]; ok {
+				return pinger, true
+			}
+		}
 	}
+	return nil, false
 }
 
 func (bp *BatchPinger) processPacket(recv *packet) error {
@@ -302,16 +593,58 @@ func (bp *BatchPinger) processPacket(recv *packet) error {
 			return nil
 		}
 
-		if len(pkt.Data) < timeSliceLength+trackerLength {
+		if len(pkt.Data) < timeSliceLength+trackerLength+tokenLength {
 			return fmt.Errorf("insufficient data received; got: %d %v",
 				len(pkt.Data), pkt.Data)
 		}
 
 		timestamp := bytesToTime(pkt.Data[:timeSliceLength])
 
-		if pinger, ok := bp.mapSeqPinger[pkt.Seq]; ok {
-			pinger.PacketsRecv++
-			pinger.rtts = append(pinger.rtts, receivedAt.Sub(timestamp))
+		var tok token
+		copy(tok[:], pkt.Data[timeSliceLength+trackerLength:timeSliceLength+trackerLength+tokenLength])
+
+		key := outstandingKey{seq: pkt.Seq, token: tok}
+
+		bp.outstandingMu.Lock()
+		req, ok := bp.outstanding[key]
+		if ok {
+			delete(bp.outstanding, key)
+		}
+		bp.outstandingMu.Unlock()
+
+		if !ok {
+			// Either a duplicate of an already-counted reply, or a stale
+			// reply whose seq has since been recycled into a new round.
+			// tok disambiguates which shard's pinger actually sent it,
+			// since seq alone is reused independently by every shard.
+			if pinger, found := bp.pingerBySeq(pkt.Seq, tok); found {
+				pinger.PacketsRecvDuplicates++
+			}
+			if bp.debug {
+				log.Printf("drop unmatched reply seq=%d \n", pkt.Seq)
+			}
+			return nil
+		}
+
+		if req.release != nil {
+			req.release()
+		}
+
+		rtt := receivedAt.Sub(timestamp)
+
+		if req.resultCh != nil {
+			// One-shot request from Ping: deliver directly, it carries no
+			// Pinger registered in any shard.
+			req.resultCh <- PingResult{RTT: rtt, TTL: recv.ttl}
+			return nil
+		}
+
+		if req.pinger != nil {
+			req.pinger.PacketsRecv++
+			req.pinger.rtts = append(req.pinger.rtts, rtt)
+			if bp.OnRecv != nil {
+				bp.OnRecv(req.addr, pkt.Seq, rtt, recv.ttl)
+			}
 		}
 
 	default:
@@ -323,12 +656,21 @@ func (bp *BatchPinger) processPacket(recv *packet) error {
 
 }
 
-// Statistics is all addr data Statistic
+// Statistics is all addr data Statistic, keyed by the original addr each
+// pinger was constructed with (sh.hosts), not by pinger.addr: under
+// SetResolveInterval, pinger.addr is whatever IP a hostname target last
+// resolved to, so keying by it would fold the counts from every IP a
+// hostname has ever pointed at into whichever one it happens to be
+// pointed at right now, and could collide two different hostnames that
+// transiently resolve to the same IP.
 func (bp *BatchPinger) Statistics() map[string]*Statistics {
 	stMap := map[string]*Statistics{}
-	for _, pinger := range bp.mapSeqPinger {
-		x := pinger.Statistics()
-		stMap[pinger.addr] = x
+	bp.addrMu.RLock()
+	defer bp.addrMu.RUnlock()
+	for _, sh := range bp.shards {
+		for seq, pinger := range sh.mapSeqPinger {
+			stMap[sh.hosts[seq]] = pinger.Statistics()
+		}
 	}
 	return stMap
 }
@@ -0,0 +1,85 @@
+package ping
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// requireRawICMP skips t unless this process can open a raw ip4:icmp
+// socket (typically needs root or CAP_NET_RAW; unprivileged "udp" ping
+// via net.ipv4.ping_group_range does not satisfy it) - RunContext and Ping
+// both need a real conn to do anything observable.
+func requireRawICMP(t *testing.T) {
+	t.Helper()
+	conn, err := icmp.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("raw ICMP unavailable in this environment: %v", err)
+	}
+	conn.Close()
+}
+
+// TestRunContextPingsLoopback verifies Run/RunContext actually sends and
+// matches replies end to end against a real target.
+func TestRunContextPingsLoopback(t *testing.T) {
+	requireRawICMP(t)
+
+	bp, err := NewBatchPinger([]string{"127.0.0.1"}, true)
+	if err != nil {
+		t.Fatalf("NewBatchPinger: %v", err)
+	}
+	bp.SetCount(2)
+	bp.SetInterval(20 * time.Millisecond)
+	bp.SetTimeout(2 * time.Second)
+
+	if err := bp.RunContext(context.Background()); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+
+	st := bp.Statistics()["127.0.0.1"]
+	if st == nil {
+		t.Fatal("Statistics() has no entry for 127.0.0.1")
+	}
+	if st.PacketsRecv == 0 {
+		t.Error("expected at least one matched reply from loopback")
+	}
+}
+
+// TestRunContextStopsOnCtxCancel verifies RunContext returns promptly once
+// ctx is canceled, rather than running until its (very long by default)
+// Timeout elapses.
+func TestRunContextStopsOnCtxCancel(t *testing.T) {
+	requireRawICMP(t)
+
+	bp, err := NewBatchPinger([]string{"127.0.0.1"}, true)
+	if err != nil {
+		t.Fatalf("NewBatchPinger: %v", err)
+	}
+	bp.SetInterval(20 * time.Millisecond)
+	bp.SetTimeout(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- bp.RunContext(ctx) }()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunContext did not return after ctx was canceled")
+	}
+}
+
+// TestStopIsIdempotent verifies Stop can be called more than once without
+// panicking.
+func TestStopIsIdempotent(t *testing.T) {
+	bp, err := NewBatchPinger(nil, true)
+	if err != nil {
+		t.Fatalf("NewBatchPinger: %v", err)
+	}
+	bp.Stop()
+	bp.Stop()
+}
@@ -0,0 +1,85 @@
+package ping
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func echoReplyBytes(t *testing.T, id, seq int, tok token) []byte {
+	t.Helper()
+	data := append(append(timeToBytes(time.Now()), trackerToBytes(1)...), tok[:]...)
+	wb, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Code: 0,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: data},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("marshal echo reply: %v", err)
+	}
+	return wb
+}
+
+func newTestBatchPinger(t *testing.T) *BatchPinger {
+	t.Helper()
+	bp, err := NewBatchPinger(nil, true)
+	if err != nil {
+		t.Fatalf("NewBatchPinger: %v", err)
+	}
+	return bp
+}
+
+// TestProcessPacketMatchesOutstanding verifies a fresh reply is matched to
+// its outstanding request by (seq, token), credited to the right pinger,
+// and removed from bp.outstanding.
+func TestProcessPacketMatchesOutstanding(t *testing.T) {
+	bp := newTestBatchPinger(t)
+	pinger := &Pinger{addr: "203.0.113.1"}
+	tok, _ := newToken()
+	key := outstandingKey{seq: 1, token: tok}
+	bp.outstanding[key] = &outstandingRequest{addr: pinger.addr, sentAt: time.Now(), pinger: pinger}
+
+	pkt := &packet{bytes: echoReplyBytes(t, bp.id, 1, tok), proto: protoIpv4}
+	pkt.nbytes = len(pkt.bytes)
+
+	if err := bp.processPacket(pkt); err != nil {
+		t.Fatalf("processPacket: %v", err)
+	}
+
+	if pinger.PacketsRecv != 1 {
+		t.Errorf("PacketsRecv = %d, want 1", pinger.PacketsRecv)
+	}
+	if len(pinger.rtts) != 1 {
+		t.Errorf("len(rtts) = %d, want 1", len(pinger.rtts))
+	}
+	if _, ok := bp.outstanding[key]; ok {
+		t.Error("matched request should have been removed from bp.outstanding")
+	}
+}
+
+// TestProcessPacketStaleReplyWrongToken verifies a reply whose token
+// doesn't match any outstanding or recently-active request for its seq is
+// dropped without being credited to any pinger - guarding against spoofed
+// or stale replies being counted as a duplicate of the wrong round.
+func TestProcessPacketStaleReplyWrongToken(t *testing.T) {
+	bp := newTestBatchPinger(t)
+	sh := newShard([]string{"203.0.113.1"}, 0)
+	pinger := &Pinger{addr: "203.0.113.1", seq: 1}
+	sh.mapSeqPinger[1] = pinger
+	activeTok, _ := newToken()
+	sh.activeKeyBySeq[1] = outstandingKey{seq: 1, token: activeTok}
+	bp.shards = []*shard{sh}
+
+	staleTok, _ := newToken()
+	pkt := &packet{bytes: echoReplyBytes(t, bp.id, 1, staleTok), proto: protoIpv4}
+	pkt.nbytes = len(pkt.bytes)
+
+	if err := bp.processPacket(pkt); err != nil {
+		t.Fatalf("processPacket: %v", err)
+	}
+	if pinger.PacketsRecvDuplicates != 0 {
+		t.Errorf("PacketsRecvDuplicates = %d, want 0 for a reply carrying an unrecognized token", pinger.PacketsRecvDuplicates)
+	}
+}
@@ -0,0 +1,78 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// PingResult is the outcome of one ad-hoc echo request sent via Ping.
+type PingResult struct {
+	RTT time.Duration
+	TTL int
+	Err error
+}
+
+// nextAdHocSeq returns a seq ID reserved for Ping. icmp.Echo.Seq is
+// marshaled onto the wire as a uint16, so a reply's pkt.Seq is always that
+// truncated value; the untruncated int previously returned here (0xffff+n,
+// above 0xffff from n=1 on) diverged from it immediately, meaning the key Ping registered in
+// bp.outstanding could never match an incoming reply's key and Ping always
+// fell through to the ctx-timeout path. Truncating here keeps the two
+// consistent. The (seq, token) pair still disambiguates a Ping request from
+// any shard's request that happens to carry the same wire seq.
+func (bp *BatchPinger) nextAdHocSeq() int {
+	return int(uint16(0xffff + atomic.AddInt32(&bp.adHocSeq, 1)))
+}
+
+// Ping sends a single echo request to addr and returns a channel that
+// receives at most one PingResult: the first matching reply, or an error
+// derived from ctx if it is canceled first. If the BatchPinger is stopped
+// before either happens, nothing is sent on the channel. It reuses the conn4/conn6 and
+// receive loops set up by a prior Run or RunContext call, so callers can
+// fire ad-hoc probes without spinning up a separate BatchPinger.
+func (bp *BatchPinger) Ping(ctx context.Context, addr string) (<-chan PingResult, error) {
+	bp.connMu.RLock()
+	conn4, conn6 := bp.conn4, bp.conn6
+	bp.connMu.RUnlock()
+	if conn4 == nil || conn6 == nil {
+		return nil, errors.New("ping: Run or RunContext must be started first")
+	}
+
+	pinger, err := NewPinger(addr, bp.id, bp.nextAdHocSeq(), bp.network)
+	if err != nil {
+		return nil, err
+	}
+	pinger.SetConns(conn4, conn6)
+
+	tok, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	key := outstandingKey{seq: pinger.seq, token: tok}
+	resultCh := make(chan PingResult, 1)
+
+	bp.outstandingMu.Lock()
+	bp.outstanding[key] = &outstandingRequest{addr: addr, sentAt: time.Now(), resultCh: resultCh}
+	bp.outstandingMu.Unlock()
+
+	pinger.SendICMP(tok[:])
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			bp.outstandingMu.Lock()
+			_, stillPending := bp.outstanding[key]
+			delete(bp.outstanding, key)
+			bp.outstandingMu.Unlock()
+			if stillPending {
+				resultCh <- PingResult{Err: ctx.Err()}
+			}
+		case <-bp.done:
+		}
+	}()
+
+	return resultCh, nil
+}
@@ -0,0 +1,86 @@
+package ping
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestNextAdHocSeqTruncatesToWireValue verifies nextAdHocSeq returns the
+// same value a reply's pkt.Seq will carry (icmp.Echo.Seq is marshaled as a
+// uint16), including wrapping correctly once the running count overflows
+// 16 bits.
+func TestNextAdHocSeqTruncatesToWireValue(t *testing.T) {
+	bp, err := NewBatchPinger(nil, true)
+	if err != nil {
+		t.Fatalf("NewBatchPinger: %v", err)
+	}
+
+	first := bp.nextAdHocSeq()
+	second := bp.nextAdHocSeq()
+	if first == second {
+		t.Fatalf("nextAdHocSeq returned the same value twice: %d", first)
+	}
+	if first < 0 || first > 0xffff || second < 0 || second > 0xffff {
+		t.Fatalf("nextAdHocSeq returned a value outside the wire uint16 range: %d, %d", first, second)
+	}
+
+	// Drive adHocSeq up near the uint16 wrap point and confirm it wraps
+	// rather than escaping the 0..0xffff range the wire truncates to.
+	bp.adHocSeq = 0xfffe
+	wrapped := bp.nextAdHocSeq()
+	if wrapped < 0 || wrapped > 0xffff {
+		t.Fatalf("nextAdHocSeq did not stay within the wire uint16 range after wrapping: %d", wrapped)
+	}
+}
+
+// TestPingMatchesRealReply verifies Ping resolves via an actual matched
+// reply rather than falling through to the ctx-timeout path - the bug
+// nextAdHocSeq's truncation fix addressed.
+func TestPingMatchesRealReply(t *testing.T) {
+	requireRawICMP(t)
+
+	bp, err := NewBatchPinger(nil, true)
+	if err != nil {
+		t.Fatalf("NewBatchPinger: %v", err)
+	}
+	bp.SetTimeout(time.Hour)
+
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	go bp.RunContext(runCtx)
+
+	// Make Ping's own call the second one: the untruncated seq this
+	// returned before (0xffff+2) never matched what actually arrived on
+	// the wire.
+	bp.nextAdHocSeq()
+
+	pingCtx, cancelPing := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelPing()
+
+	// Ping returns an explicit error until RunContext's goroutine has
+	// opened its conns, so retry until that happens.
+	var resultCh <-chan PingResult
+	for {
+		resultCh, err = bp.Ping(pingCtx, "127.0.0.1")
+		if err == nil {
+			break
+		}
+		select {
+		case <-pingCtx.Done():
+			t.Fatalf("Ping: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	select {
+	case res := <-resultCh:
+		if res.Err != nil {
+			t.Fatalf("Ping result: %v", res.Err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Ping never resolved via a matched reply")
+	}
+
+	bp.Stop()
+}
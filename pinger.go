@@ -0,0 +1,255 @@
+package ping
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// protoIpv4 and protoIpv6 tag a received packet by address family.
+const (
+	protoIpv4 = iota
+	protoIpv6
+)
+
+// protocolICMP and protocolIPv6ICMP are the IANA protocol numbers
+// icmp.ParseMessage needs to tell an ICMPv4 message apart from an ICMPv6
+// one; golang.org/x/net/icmp doesn't export its own copies.
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// ipv4Proto and ipv6Proto pick the icmp.ListenPacket network for each
+// BatchPinger.network mode: "ip" needs CAP_NET_RAW/root, "udp" works
+// unprivileged on platforms that support it (notably Linux, with
+// net.ipv4.ping_group_range configured).
+var ipv4Proto = map[string]string{
+	"ip":  "ip4:icmp",
+	"udp": "udp4",
+}
+
+var ipv6Proto = map[string]string{
+	"ip":  "ip6:ipv6-icmp",
+	"udp": "udp6",
+}
+
+// timeSliceLength and trackerLength size the timestamp and per-Pinger
+// tracker that SendICMP embeds in every echo's Data ahead of the
+// tokenLength random token defined in token.go.
+const (
+	timeSliceLength = 8
+	trackerLength   = 8
+)
+
+// packet is one read off conn4 or conn6, before it's parsed into an
+// icmp.Message.
+type packet struct {
+	bytes  []byte
+	nbytes int
+	ttl    int
+	proto  int
+}
+
+// Pinger sends echo requests to, and tracks statistics for, a single addr.
+// BatchPinger owns one per addr per shard; RunTraceroute builds its own
+// transient ones.
+type Pinger struct {
+	// addr is the current target: the literal IP NewPinger resolved addr
+	// to, or whatever a SetResolveInterval retarget has since updated it
+	// to via reresolveShard.
+	addr string
+
+	// id is the ICMP ID every echo from this Pinger carries; it's shared
+	// across a BatchPinger's Pingers, set to the process id, so replies
+	// meant for another process sharing the host can be told apart.
+	id int
+
+	// seq is the ICMP Seq the next SendICMP call will use.
+	seq int
+
+	// network is "ip" (privileged) or "udp" (unprivileged), mirroring
+	// BatchPinger.network; it decides how WriteTo's dst is typed.
+	network string
+
+	// tracker further distinguishes this Pinger's own echoes on the wire,
+	// independent of the (seq, token) matching BatchPinger does in-memory.
+	tracker int64
+
+	conn4 *icmp.PacketConn
+	conn6 *icmp.PacketConn
+
+	// PacketsSent, PacketsRecv, and PacketsRecvDuplicates are incremented
+	// directly by BatchPinger as it sends and matches replies.
+	PacketsSent           int
+	PacketsRecv           int
+	PacketsRecvDuplicates int
+
+	// rtts collects one entry per matched reply, appended directly by
+	// BatchPinger.processPacket.
+	rtts []time.Duration
+}
+
+// NewPinger resolves addr once and returns a Pinger targeting it. id is
+// shared across a batch; seq is this Pinger's starting ICMP Seq.
+func NewPinger(addr string, id, seq int, network string) (*Pinger, error) {
+	ipaddr, err := net.ResolveIPAddr("ip", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker, err := randomTracker()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pinger{
+		addr:    ipaddr.String(),
+		id:      id,
+		seq:     seq,
+		network: network,
+		tracker: tracker,
+	}, nil
+}
+
+// SetConns gives the Pinger the conns SendICMP writes through; BatchPinger
+// and RunTraceroute both share their own conn4/conn6 across every Pinger
+// they own.
+func (p *Pinger) SetConns(conn4, conn6 *icmp.PacketConn) {
+	p.conn4 = conn4
+	p.conn6 = conn6
+}
+
+// SendICMP writes one echo request to p.addr carrying p.seq, a fresh
+// timestamp and tracker, and extra (BatchPinger and RunTraceroute both pass
+// a random token here). p.addr is re-parsed on every call rather than
+// cached as a *net.IPAddr so a SetResolveInterval retarget - which only
+// ever touches the addr string - takes effect on the very next send.
+func (p *Pinger) SendICMP(extra []byte) error {
+	ip := net.ParseIP(p.addr)
+	if ip == nil {
+		return fmt.Errorf("pinger: invalid addr %q", p.addr)
+	}
+
+	data := make([]byte, 0, timeSliceLength+trackerLength+len(extra))
+	data = append(data, timeToBytes(time.Now())...)
+	data = append(data, trackerToBytes(p.tracker)...)
+	data = append(data, extra...)
+
+	body := &icmp.Echo{ID: p.id, Seq: p.seq, Data: data}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		wb, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Code: 0, Body: body}).Marshal(nil)
+		if err != nil {
+			return err
+		}
+		_, err = p.conn4.WriteTo(wb, p.dstAddr(ip4))
+		return err
+	}
+
+	wb, err := (&icmp.Message{Type: ipv6.ICMPTypeEchoRequest, Code: 0, Body: body}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+	_, err = p.conn6.WriteTo(wb, p.dstAddr(ip))
+	return err
+}
+
+// dstAddr types ip the way WriteTo expects for p.network: an unprivileged
+// "udp" conn dials by *net.UDPAddr, a privileged "ip" conn by *net.IPAddr.
+func (p *Pinger) dstAddr(ip net.IP) net.Addr {
+	if p.network == "udp" {
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.IPAddr{IP: ip}
+}
+
+// Statistics summarizes one addr's round-trip results.
+type Statistics struct {
+	Addr                  string
+	PacketsSent           int
+	PacketsRecv           int
+	PacketsRecvDuplicates int
+	PacketLoss            float64
+	MinRtt                time.Duration
+	MaxRtt                time.Duration
+	AvgRtt                time.Duration
+	StdDevRtt             time.Duration
+}
+
+// Statistics computes p's current Statistics from its rtts and packet
+// counters.
+func (p *Pinger) Statistics() *Statistics {
+	st := &Statistics{
+		Addr:                  p.addr,
+		PacketsSent:           p.PacketsSent,
+		PacketsRecv:           p.PacketsRecv,
+		PacketsRecvDuplicates: p.PacketsRecvDuplicates,
+	}
+	if p.PacketsSent > 0 {
+		st.PacketLoss = float64(p.PacketsSent-p.PacketsRecv) / float64(p.PacketsSent) * 100
+	}
+	if len(p.rtts) == 0 {
+		return st
+	}
+
+	st.MinRtt, st.MaxRtt = p.rtts[0], p.rtts[0]
+	var total time.Duration
+	for _, rtt := range p.rtts {
+		if rtt < st.MinRtt {
+			st.MinRtt = rtt
+		}
+		if rtt > st.MaxRtt {
+			st.MaxRtt = rtt
+		}
+		total += rtt
+	}
+	st.AvgRtt = total / time.Duration(len(p.rtts))
+
+	var sumSquareDiff float64
+	for _, rtt := range p.rtts {
+		diff := float64(rtt - st.AvgRtt)
+		sumSquareDiff += diff * diff
+	}
+	st.StdDevRtt = time.Duration(math.Sqrt(sumSquareDiff / float64(len(p.rtts))))
+
+	return st
+}
+
+// randomTracker returns a random int64 to seed a new Pinger's tracker.
+func randomTracker() (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return 0, err
+	}
+	return n.Int64(), nil
+}
+
+// timeToBytes and bytesToTime encode/decode the timestamp every echo
+// carries in the first timeSliceLength bytes of Data, used to compute RTT
+// on a matched reply.
+func timeToBytes(t time.Time) []byte {
+	b := make([]byte, timeSliceLength)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func bytesToTime(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
+
+// trackerToBytes encodes a Pinger's tracker into the trackerLength bytes of
+// Data immediately following the timestamp.
+func trackerToBytes(tracker int64) []byte {
+	b := make([]byte, trackerLength)
+	binary.BigEndian.PutUint64(b, uint64(tracker))
+	return b
+}
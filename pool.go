@@ -0,0 +1,21 @@
+package ping
+
+// SetParallelism sets how many shards (each holding up to 0xffff addrs) send
+// and await replies concurrently. Default is 1, meaning shards run one after
+// another, as a single un-sharded BatchPinger always did.
+func (bp *BatchPinger) SetParallelism(n int) {
+	if n < 1 {
+		n = 1
+	}
+	bp.parallelism = n
+}
+
+// SetMaxInflight bounds how many un-replied-to echo requests a shard may
+// have outstanding at once, pacing bursts the way fastping does. 0 (the
+// default) leaves sends unbounded.
+func (bp *BatchPinger) SetMaxInflight(n int) {
+	if n < 0 {
+		n = 0
+	}
+	bp.maxInflight = n
+}
@@ -0,0 +1,111 @@
+package ping
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// Resolver resolves a hostname to the IP addresses it currently points at.
+// SetResolver lets callers substitute a custom implementation (e.g. one
+// backed by a service registry) for defaultResolver.
+type Resolver interface {
+	Resolve(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// defaultResolver resolves through net.DefaultResolver, abandoning a
+// lookup once ctx is canceled or its deadline expires.
+type defaultResolver struct{}
+
+func (defaultResolver) Resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return net.DefaultResolver.LookupIPAddr(ctx, host)
+}
+
+// SetResolver overrides the Resolver RunContext uses to re-resolve hostname
+// targets when SetResolveInterval is set. The default wraps
+// net.DefaultResolver.
+func (bp *BatchPinger) SetResolver(r Resolver) {
+	bp.resolver = r
+}
+
+// SetResolveInterval makes RunContext re-resolve every hostname addr this
+// often between rounds, so long-running batches notice DNS changes (GSLB,
+// k8s headless Services, cloud LB rotation) instead of pinning whatever IP
+// NewPinger resolved at startup. 0 (the default) disables re-resolution.
+// Addrs that are already literal IPs are never re-resolved.
+func (bp *BatchPinger) SetResolveInterval(d time.Duration) {
+	bp.resolveInterval = d
+}
+
+// reresolveShard re-resolves every hostname addr in sh and retargets its
+// pinger when the resolved IP has changed, recording the change in
+// bp.ipHistory. Addrs sh.hosts holds as a literal IP are skipped.
+// pinger.addr is written under bp.addrMu since Statistics can read it from
+// a caller goroutine while this shard's run is still in flight.
+func (bp *BatchPinger) reresolveShard(ctx context.Context, sh *shard) {
+	for seq, pinger := range sh.mapSeqPinger {
+		host := sh.hosts[seq]
+		if host == "" || net.ParseIP(host) != nil {
+			continue
+		}
+
+		addrs, err := bp.resolver.Resolve(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			if bp.debug {
+				log.Printf("resolve err host %s: %v \n", host, err)
+			}
+			continue
+		}
+
+		newAddr := addrs[0].String()
+
+		bp.addrMu.Lock()
+		changed := newAddr != pinger.addr
+		if changed {
+			pinger.addr = newAddr
+		}
+		bp.addrMu.Unlock()
+
+		if changed {
+			bp.recordIPHistory(host, addrs[0])
+		}
+	}
+}
+
+// recordIPHistory appends ip to host's history, unless ip is already in it.
+// IPHistory promises the distinct IPs seen for a host, not every
+// transition, so a target flapping between the same two IPs - ordinary
+// GSLB/round-robin/k8s-headless-Service behavior, and exactly the case
+// SetResolveInterval exists for - must not grow the history on every flip
+// back to an IP already recorded.
+func (bp *BatchPinger) recordIPHistory(host string, ip net.IPAddr) {
+	bp.ipHistoryMu.Lock()
+	defer bp.ipHistoryMu.Unlock()
+
+	for _, seen := range bp.ipHistory[host] {
+		if seen.String() == ip.String() {
+			return
+		}
+	}
+	bp.ipHistory[host] = append(bp.ipHistory[host], ip)
+}
+
+// IPHistory returns, for every hostname addr SetResolveInterval has
+// re-resolved to a changed IP, the distinct IPs it was retargeted to, in
+// the order they were first observed. The IP NewPinger resolved at startup
+// is included only if a later re-resolution switched back to it. Addrs that
+// resolved to the same IP throughout, or were passed as literal IPs, are
+// absent.
+func (bp *BatchPinger) IPHistory() map[string][]net.IPAddr {
+	bp.ipHistoryMu.Lock()
+	defer bp.ipHistoryMu.Unlock()
+
+	out := make(map[string][]net.IPAddr, len(bp.ipHistory))
+	for host, ips := range bp.ipHistory {
+		cp := make([]net.IPAddr, len(ips))
+		copy(cp, ips)
+		out[host] = cp
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// flappingResolver cycles through ips on every Resolve call, simulating a
+// GSLB/round-robin/k8s-headless-Service target that flips between the same
+// few addresses.
+type flappingResolver struct {
+	ips []net.IPAddr
+	n   int
+}
+
+func (r *flappingResolver) Resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ip := r.ips[r.n%len(r.ips)]
+	r.n++
+	return []net.IPAddr{ip}, nil
+}
+
+func TestRecordIPHistoryDedupesAgainstFullHistory(t *testing.T) {
+	bp := newTestBatchPinger(t)
+	a := net.IPAddr{IP: net.ParseIP("10.0.0.1")}
+	b := net.IPAddr{IP: net.ParseIP("10.0.0.2")}
+
+	bp.recordIPHistory("svc", a)
+	bp.recordIPHistory("svc", b)
+	bp.recordIPHistory("svc", a) // flip back to an IP already recorded
+
+	got := bp.IPHistory()["svc"]
+	if len(got) != 2 {
+		t.Fatalf("IPHistory()[%q] = %v, want 2 distinct entries", "svc", got)
+	}
+}
+
+// TestReresolveShardDoesNotGrowHistoryOnFlapping drives reresolveShard
+// through several rounds of a target flipping between two IPs and checks
+// IPHistory stays at the 2 distinct IPs actually seen, rather than growing
+// by one entry per round.
+func TestReresolveShardDoesNotGrowHistoryOnFlapping(t *testing.T) {
+	bp := newTestBatchPinger(t)
+	bp.SetResolver(&flappingResolver{ips: []net.IPAddr{
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("10.0.0.2")},
+	}})
+
+	sh := newShard([]string{"svc.internal"}, 0)
+	sh.hosts[1] = "svc.internal"
+	sh.mapSeqPinger[1] = &Pinger{addr: "10.0.0.1"}
+
+	for i := 0; i < 8; i++ {
+		bp.reresolveShard(context.Background(), sh)
+	}
+
+	got := bp.IPHistory()["svc.internal"]
+	if len(got) != 2 {
+		t.Fatalf("IPHistory()[%q] = %v (%d entries) after repeated flapping, want 2", "svc.internal", got, len(got))
+	}
+}
+
+// TestStatisticsKeyedByHostNotLiveAddr verifies Statistics() keys its
+// output by the original addr a pinger was constructed with, not by
+// pinger.addr, which a SetResolveInterval retarget mutates in place.
+func TestStatisticsKeyedByHostNotLiveAddr(t *testing.T) {
+	bp := newTestBatchPinger(t)
+	sh := newShard([]string{"svc.internal"}, 0)
+	sh.hosts[1] = "svc.internal"
+	pinger := &Pinger{addr: "10.0.0.1", PacketsSent: 1, PacketsRecv: 1}
+	sh.mapSeqPinger[1] = pinger
+	bp.shards = []*shard{sh}
+
+	pinger.addr = "10.0.0.2" // simulate a resolver retarget
+
+	stats := bp.Statistics()
+	st, ok := stats["svc.internal"]
+	if !ok {
+		t.Fatalf("Statistics() has no entry keyed by host %q; got %+v", "svc.internal", stats)
+	}
+	if st.PacketsSent != 1 || st.PacketsRecv != 1 {
+		t.Errorf("Statistics()[%q] = %+v, want PacketsSent=1 PacketsRecv=1", "svc.internal", st)
+	}
+	if _, ok := stats["10.0.0.2"]; ok {
+		t.Error("Statistics() must not be keyed by the live pinger addr")
+	}
+}
@@ -0,0 +1,66 @@
+package ping
+
+import "sync"
+
+// maxShardSize is the largest seq space a single shard can address: the
+// ICMP Seq field is 16 bits, so a batch of more than this many addrs must be
+// split across shards that each recycle their own 1..maxShardSize range.
+const maxShardSize = 0xffff
+
+// shard owns one batch of at most maxShardSize addrs, its own seq space, and
+// the bookkeeping needed to recycle that seq space safely across rounds.
+// BatchPinger runs shards through a worker pool sized by SetParallelism so a
+// single BatchPinger can sweep more than 65535 targets.
+type shard struct {
+	addrs []string
+
+	//mapSeqPinger is this shard's seqId pinger map
+	mapSeqPinger map[int]*Pinger
+
+	// hosts remembers the original addr passed to NewPinger for each seq,
+	// independent of whatever pinger.addr becomes after a SetResolveInterval
+	// retarget, so results stay keyed by the logical target.
+	hosts map[int]string
+
+	// activeKeyMu guards activeKeyBySeq: batchSendShard writes it and
+	// sweepOutstanding reads it from this shard's own runShard goroutine, but pingerBySeq
+	// now also reads it from whichever goroutine (recvIpv4 or recvIpv6) an
+	// unmatched reply happens to land on.
+	activeKeyMu sync.Mutex
+
+	// activeKeyBySeq remembers the (seq, token) most recently sent for each
+	// seq in this shard, so batchSendShard can evict and report as timed-out
+	// a prior round's request before its seq is reused.
+	activeKeyBySeq map[int]outstandingKey
+
+	// inflight paces bursts when BatchPinger.maxInflight > 0; nil means
+	// sends are unbounded.
+	inflight chan struct{}
+}
+
+// newShard builds a shard for addrs. maxInflight mirrors BatchPinger.maxInflight: 0 leaves the shard unbounded.
+func newShard(addrs []string, maxInflight int) *shard {
+	sh := &shard{
+		addrs:          addrs,
+		mapSeqPinger:   make(map[int]*Pinger),
+		hosts:          make(map[int]string),
+		activeKeyBySeq: make(map[int]outstandingKey),
+	}
+	if maxInflight > 0 {
+		sh.inflight = make(chan struct{}, maxInflight)
+	}
+	return sh
+}
+
+// shardAddrs splits addrs into chunks of at most maxShardSize.
+func shardAddrs(addrs []string) [][]string {
+	var shards [][]string
+	for i := 0; i < len(addrs); i += maxShardSize {
+		end := i + maxShardSize
+		if end > len(addrs) {
+			end = len(addrs)
+		}
+		shards = append(shards, addrs[i:end])
+	}
+	return shards
+}
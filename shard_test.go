@@ -0,0 +1,79 @@
+package ping
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPingerBySeqDisambiguatesAcrossShards verifies that when two shards
+// independently number a pinger with the same seq, a reply is attributed to
+// whichever shard's pinger actually sent it (identified by tok), not
+// whichever shard happens to be checked first.
+func TestPingerBySeqDisambiguatesAcrossShards(t *testing.T) {
+	bp := newTestBatchPinger(t)
+
+	sh1 := newShard([]string{"203.0.113.1"}, 0)
+	pinger1 := &Pinger{addr: "203.0.113.1"}
+	sh1.mapSeqPinger[1] = pinger1
+	tok1, _ := newToken()
+	sh1.activeKeyBySeq[1] = outstandingKey{seq: 1, token: tok1}
+
+	sh2 := newShard([]string{"203.0.113.2"}, 0)
+	pinger2 := &Pinger{addr: "203.0.113.2"}
+	sh2.mapSeqPinger[1] = pinger2
+	tok2, _ := newToken()
+	sh2.activeKeyBySeq[1] = outstandingKey{seq: 1, token: tok2}
+
+	bp.shards = []*shard{sh1, sh2}
+
+	got, found := bp.pingerBySeq(1, tok2)
+	if !found {
+		t.Fatal("expected a pinger to be found for tok2")
+	}
+	if got != pinger2 {
+		t.Errorf("pingerBySeq matched the wrong shard's pinger for seq 1, tok2")
+	}
+}
+
+// TestSweepOutstandingReportsTimeoutAndReleases verifies that a shard's
+// still-pending requests (the final round's, typically, since nothing ever
+// evicts them short of a subsequent send on the same seq) are reported via
+// OnTimeout and have their inflight slot released when the shard finishes.
+func TestSweepOutstandingReportsTimeoutAndReleases(t *testing.T) {
+	bp := newTestBatchPinger(t)
+	sh := newShard([]string{"203.0.113.1"}, 1)
+
+	tok, _ := newToken()
+	key := outstandingKey{seq: 1, token: tok}
+	sh.activeKeyBySeq[1] = key
+
+	sh.inflight <- struct{}{}
+	released := false
+	bp.outstanding[key] = &outstandingRequest{
+		addr:   "203.0.113.1",
+		sentAt: time.Now(),
+		release: func() {
+			released = true
+			<-sh.inflight
+		},
+	}
+
+	var timedOutAddr string
+	var timedOutSeq int
+	bp.OnTimeout = func(addr string, seq int) {
+		timedOutAddr = addr
+		timedOutSeq = seq
+	}
+
+	bp.sweepOutstanding(sh)
+
+	if timedOutAddr != "203.0.113.1" || timedOutSeq != 1 {
+		t.Errorf("OnTimeout called with (%q, %d), want (\"203.0.113.1\", 1)", timedOutAddr, timedOutSeq)
+	}
+	if !released {
+		t.Error("expected the swept request's release func to be called")
+	}
+	if _, ok := bp.outstanding[key]; ok {
+		t.Error("swept request should have been removed from bp.outstanding")
+	}
+}
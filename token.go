@@ -0,0 +1,45 @@
+package ping
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// tokenLength is the size, in bytes, of the random token embedded in every
+// echo request's Data (immediately after the timestamp and tracker). It lets
+// processPacket tell a fresh reply for the current round apart from a stale
+// or duplicate reply carrying a seq that has since been reused.
+const tokenLength = 16
+
+// token uniquely identifies one outbound echo request.
+type token [tokenLength]byte
+
+// newToken returns a cryptographically random token.
+func newToken() (token, error) {
+	var t token
+	_, err := rand.Read(t[:])
+	return t, err
+}
+
+// outstandingKey identifies one in-flight echo request by the (seq, token)
+// pair carried in its Data, since seq alone is reused across rounds.
+type outstandingKey struct {
+	seq   int
+	token token
+}
+
+// outstandingRequest records the bookkeeping needed to resolve a reply: which
+// addr and Pinger sent it and when, so a match can be reported via OnRecv.
+//
+// resultCh is non-nil only for one-shot requests registered by Ping; a
+// matching reply is delivered there instead of through OnRecv/pinger.
+//
+// release is non-nil only when the sending shard has a MaxInflight cap; it
+// frees that request's slot once the request is resolved, matched or not.
+type outstandingRequest struct {
+	addr     string
+	sentAt   time.Time
+	pinger   *Pinger
+	resultCh chan PingResult
+	release  func()
+}
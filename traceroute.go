@@ -0,0 +1,273 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Hop is one step on the path to an addr discovered by RunTraceroute: the
+// router (or, on the final hop, addr itself) that replied, and the RTT of
+// the probe that revealed it. Addr is empty if nothing replied before the
+// per-hop timeout.
+type Hop struct {
+	Addr string
+	RTT  time.Duration
+}
+
+// hopTimeout bounds how long RunTraceroute waits for a single TTL/HopLimit's
+// reply before recording it as silent and moving on to the next one.
+const hopTimeout = time.Second * 2
+
+// ipv4HeaderLen and ipv6HeaderLen size the original-packet copy an
+// ICMPTypeTimeExceeded carries, so the original echo request embedded in it
+// can be parsed back out. IPv4 options are not accounted for.
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+)
+
+// traceConn pairs the conn4/conn6 one concurrent traceAddr worker owns.
+// TTL/HopLimit is a per-socket option, not per-packet, so concurrent
+// traceAddr calls must never share a conn: each worker in RunTraceroute's
+// pool gets its own pair, opened the same way RunContext opens bp's.
+type traceConn struct {
+	conn4 *icmp.PacketConn
+	conn6 *icmp.PacketConn
+}
+
+func newTraceConn(network, source string) (*traceConn, error) {
+	conn4, err := icmp.ListenPacket(ipv4Proto[network], source)
+	if err != nil {
+		return nil, err
+	}
+
+	conn6, err := icmp.ListenPacket(ipv6Proto[network], source)
+	if err != nil {
+		conn4.Close()
+		return nil, err
+	}
+
+	conn4.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+	conn6.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+
+	return &traceConn{conn4: conn4, conn6: conn6}, nil
+}
+
+func (tc *traceConn) close() {
+	tc.conn4.Close()
+	tc.conn6.Close()
+}
+
+// RunTraceroute sends, for every addr, echoes with TTL (IPv4) or HopLimit
+// (IPv6) set to 1..maxHops, recording whichever router answers with
+// ICMPTypeTimeExceeded at each hop and stopping once addr itself answers
+// with an echo reply. It traces up to SetParallelism addrs at once, each
+// through its own pair of conns opened the same way RunContext opens bp's,
+// so it can run independently of any Run/RunContext already active on bp,
+// and sweeping a large batch of addrs no longer costs maxHops*hopTimeout
+// per addr, serially.
+func (bp *BatchPinger) RunTraceroute(ctx context.Context, maxHops int) (map[string][]Hop, error) {
+	parallelism := bp.parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	pool := make(chan *traceConn, parallelism)
+	for i := 0; i < parallelism; i++ {
+		tc, err := newTraceConn(bp.network, bp.source)
+		if err != nil {
+			close(pool)
+			for tc := range pool {
+				tc.close()
+			}
+			return nil, err
+		}
+		pool <- tc
+	}
+	defer func() {
+		close(pool)
+		for tc := range pool {
+			tc.close()
+		}
+	}()
+
+	hops := make(map[string][]Hop, len(bp.addrs))
+	var hopsMu sync.Mutex
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	var seqID int
+	for _, addr := range bp.addrs {
+		seqID++
+
+		var tc *traceConn
+		select {
+		case tc = <-pool:
+		case <-ctx.Done():
+			wg.Wait()
+			return hops, ctx.Err()
+		}
+
+		pinger, err := NewPinger(addr, bp.id, seqID, bp.network)
+		if err != nil {
+			pool <- tc
+			wg.Wait()
+			return hops, err
+		}
+		pinger.SetConns(tc.conn4, tc.conn6)
+
+		wg.Add(1)
+		go func(addr string, pinger *Pinger, tc *traceConn) {
+			defer wg.Done()
+			defer func() { pool <- tc }()
+
+			addrHops, err := bp.traceAddr(ctx, tc.conn4, tc.conn6, pinger, maxHops)
+			if err != nil {
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+
+			hopsMu.Lock()
+			hops[addr] = addrHops
+			hopsMu.Unlock()
+		}(addr, pinger, tc)
+	}
+
+	wg.Wait()
+	return hops, firstErr
+}
+
+// traceAddr walks pinger's target hop by hop, returning once either addr
+// answers or maxHops is reached. It drives pinger.seq to the current ttl
+// before every send: a TimeExceeded reply only ever quotes enough of the
+// original packet to recover the ICMP header (type/code/checksum/ID/seq),
+// never our token embedded further into Data, so seq itself must vary every
+// round or a TimeExceeded that arrives late - after awaitHop already moved
+// on to the next TTL - would satisfy readTraceReply's match and get
+// attributed to the wrong hop.
+func (bp *BatchPinger) traceAddr(ctx context.Context, conn4, conn6 *icmp.PacketConn, pinger *Pinger, maxHops int) ([]Hop, error) {
+	hops := make([]Hop, 0, maxHops)
+
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if err := conn4.IPv4PacketConn().SetTTL(ttl); err != nil {
+			return hops, err
+		}
+		if err := conn6.IPv6PacketConn().SetHopLimit(ttl); err != nil {
+			return hops, err
+		}
+
+		tok, err := newToken()
+		if err != nil {
+			return hops, err
+		}
+
+		pinger.seq = ttl
+		sentAt := time.Now()
+		pinger.SendICMP(tok[:])
+
+		hop, reachedTarget, err := bp.awaitHop(ctx, conn4, conn6, pinger, tok, sentAt)
+		if err != nil {
+			return hops, err
+		}
+		hops = append(hops, hop)
+		if reachedTarget {
+			break
+		}
+	}
+
+	return hops, nil
+}
+
+// awaitHop polls conn4 and conn6 in short bursts, the same way recvIpv4 and
+// recvIpv6 poll their read deadlines, until it sees a reply attributable to
+// this probe or hopTimeout elapses.
+func (bp *BatchPinger) awaitHop(ctx context.Context, conn4, conn6 *icmp.PacketConn, pinger *Pinger, tok token, sentAt time.Time) (Hop, bool, error) {
+	deadline := sentAt.Add(hopTimeout)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return Hop{}, false, ctx.Err()
+		default:
+		}
+
+		if hop, reachedTarget, ok := bp.readTraceReply(conn4, protocolICMP, ipv4HeaderLen, ipv4.ICMPTypeEchoReply, ipv4.ICMPTypeTimeExceeded, pinger, tok, sentAt); ok {
+			return hop, reachedTarget, nil
+		}
+		if hop, reachedTarget, ok := bp.readTraceReply(conn6, protocolIPv6ICMP, ipv6HeaderLen, ipv6.ICMPTypeEchoReply, ipv6.ICMPTypeTimeExceeded, pinger, tok, sentAt); ok {
+			return hop, reachedTarget, nil
+		}
+	}
+
+	return Hop{}, false, nil
+}
+
+// readTraceReply makes one short read attempt on conn and hands whatever it
+// gets to matchTraceReply.
+func (bp *BatchPinger) readTraceReply(conn *icmp.PacketConn, proto, innerHeaderLen int, echoReplyType, timeExceededType icmp.Type, pinger *Pinger, tok token, sentAt time.Time) (Hop, bool, bool) {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+
+	buf := make([]byte, 512)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		return Hop{}, false, false
+	}
+	receivedAt := time.Now()
+
+	m, err := icmp.ParseMessage(proto, buf[:n])
+	if err != nil {
+		return Hop{}, false, false
+	}
+
+	return bp.matchTraceReply(m, from, proto, innerHeaderLen, echoReplyType, timeExceededType, pinger, tok, sentAt, receivedAt)
+}
+
+// matchTraceReply reports whether m resolves the probe identified by
+// (pinger, tok): either a matching echo reply from pinger's own target, or
+// an ICMPTypeTimeExceeded whose embedded original echo matches by ID and seq
+// (routers commonly truncate the copy before our token, so token matching
+// isn't available for this case - seq is set to the current ttl by
+// traceAddr for exactly this reason). from is the address the reply arrived
+// from, used to identify the hop that raised a TimeExceeded.
+func (bp *BatchPinger) matchTraceReply(m *icmp.Message, from net.Addr, proto, innerHeaderLen int, echoReplyType, timeExceededType icmp.Type, pinger *Pinger, tok token, sentAt, receivedAt time.Time) (Hop, bool, bool) {
+	switch m.Type {
+	case echoReplyType:
+		echo, ok := m.Body.(*icmp.Echo)
+		if !ok || echo.ID != bp.id || echo.Seq != pinger.seq {
+			return Hop{}, false, false
+		}
+		if len(echo.Data) < timeSliceLength+trackerLength+tokenLength {
+			return Hop{}, false, false
+		}
+		var gotTok token
+		copy(gotTok[:], echo.Data[timeSliceLength+trackerLength:timeSliceLength+trackerLength+tokenLength])
+		if gotTok != tok {
+			return Hop{}, false, false
+		}
+		return Hop{Addr: pinger.addr, RTT: receivedAt.Sub(sentAt)}, true, true
+
+	case timeExceededType:
+		te, ok := m.Body.(*icmp.TimeExceeded)
+		if !ok || len(te.Data) < innerHeaderLen+8 {
+			return Hop{}, false, false
+		}
+		inner, err := icmp.ParseMessage(proto, te.Data[innerHeaderLen:])
+		if err != nil {
+			return Hop{}, false, false
+		}
+		echo, ok := inner.Body.(*icmp.Echo)
+		if !ok || echo.ID != bp.id || echo.Seq != pinger.seq {
+			return Hop{}, false, false
+		}
+		return Hop{Addr: from.String(), RTT: receivedAt.Sub(sentAt)}, false, true
+	}
+
+	return Hop{}, false, false
+}
@@ -0,0 +1,105 @@
+package ping
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func marshalEcho(t *testing.T, typ icmp.Type, id, seq int, data []byte) []byte {
+	t.Helper()
+	wb, err := (&icmp.Message{
+		Type: typ,
+		Code: 0,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: data},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("marshal echo: %v", err)
+	}
+	return wb
+}
+
+func TestMatchTraceReplyEchoReply(t *testing.T) {
+	bp := &BatchPinger{id: 42}
+	pinger := &Pinger{addr: "203.0.113.1", id: 42, seq: 7}
+	tok, err := newToken()
+	if err != nil {
+		t.Fatalf("newToken: %v", err)
+	}
+
+	data := append(append(timeToBytes(time.Now()), trackerToBytes(1)...), tok[:]...)
+	m := &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 42, Seq: 7, Data: data}}
+
+	hop, reachedTarget, ok := bp.matchTraceReply(m, nil, protocolICMP, ipv4HeaderLen,
+		ipv4.ICMPTypeEchoReply, ipv4.ICMPTypeTimeExceeded, pinger, tok, time.Now(), time.Now())
+	if !ok || !reachedTarget {
+		t.Fatalf("expected matched reply reaching target, got ok=%v reachedTarget=%v", ok, reachedTarget)
+	}
+	if hop.Addr != pinger.addr {
+		t.Errorf("hop.Addr = %q, want %q", hop.Addr, pinger.addr)
+	}
+}
+
+func TestMatchTraceReplyEchoReplyWrongToken(t *testing.T) {
+	bp := &BatchPinger{id: 42}
+	pinger := &Pinger{addr: "203.0.113.1", id: 42, seq: 7}
+	tok, _ := newToken()
+	otherTok, _ := newToken()
+
+	data := append(append(timeToBytes(time.Now()), trackerToBytes(1)...), otherTok[:]...)
+	m := &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 42, Seq: 7, Data: data}}
+
+	_, _, ok := bp.matchTraceReply(m, nil, protocolICMP, ipv4HeaderLen,
+		ipv4.ICMPTypeEchoReply, ipv4.ICMPTypeTimeExceeded, pinger, tok, time.Now(), time.Now())
+	if ok {
+		t.Fatal("expected reply carrying a different token not to match")
+	}
+}
+
+func TestMatchTraceReplyTimeExceeded(t *testing.T) {
+	bp := &BatchPinger{id: 42}
+	pinger := &Pinger{addr: "203.0.113.1", id: 42, seq: 3}
+	tok, _ := newToken()
+
+	innerPacket := marshalEcho(t, ipv4.ICMPTypeEcho, 42, 3, tok[:])
+	// A real TimeExceeded only quotes the original IP header plus the first
+	// 8 bytes of its payload, so pad out to at least that much.
+	quoted := make([]byte, ipv4HeaderLen)
+	quoted = append(quoted, innerPacket...)
+
+	m := &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoted}}
+	from := &net.IPAddr{IP: net.ParseIP("198.51.100.1")}
+
+	hop, reachedTarget, ok := bp.matchTraceReply(m, from, protocolICMP, ipv4HeaderLen,
+		ipv4.ICMPTypeEchoReply, ipv4.ICMPTypeTimeExceeded, pinger, tok, time.Now(), time.Now())
+	if !ok || reachedTarget {
+		t.Fatalf("expected matched hop not reaching target, got ok=%v reachedTarget=%v", ok, reachedTarget)
+	}
+	if hop.Addr != from.String() {
+		t.Errorf("hop.Addr = %q, want router addr %q", hop.Addr, from.String())
+	}
+}
+
+func TestMatchTraceReplyTimeExceededWrongSeq(t *testing.T) {
+	bp := &BatchPinger{id: 42}
+	pinger := &Pinger{addr: "203.0.113.1", id: 42, seq: 3}
+	tok, _ := newToken()
+
+	// Simulates a TimeExceeded from an earlier hop's probe (seq 2) arriving
+	// late, after traceAddr has already moved on to probing ttl/seq 3.
+	innerPacket := marshalEcho(t, ipv4.ICMPTypeEcho, 42, 2, tok[:])
+	quoted := make([]byte, ipv4HeaderLen)
+	quoted = append(quoted, innerPacket...)
+
+	m := &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoted}}
+	from := &net.IPAddr{IP: net.ParseIP("198.51.100.1")}
+
+	_, _, ok := bp.matchTraceReply(m, from, protocolICMP, ipv4HeaderLen,
+		ipv4.ICMPTypeEchoReply, ipv4.ICMPTypeTimeExceeded, pinger, tok, time.Now(), time.Now())
+	if ok {
+		t.Fatal("expected a TimeExceeded quoting a different seq not to match the current hop")
+	}
+}